@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// installationTokenResponse is the response body of the installation access
+// token endpoint.
+// see also: https://docs.github.com/en/rest/apps/apps#create-an-installation-access-token-for-an-app
+type installationTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// appJWT mints a short-lived JSON Web Token identifying the GitHub App
+// itself, as required to request an installation access token.
+// see also: https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func appJWT(appID, privateKeyPEM string) (string, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKeyPEM))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse app private key: %s", err)
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+
+	return token.SignedString(key)
+}
+
+// installationToken exchanges a GitHub App JWT for an installation access
+// token, used to authenticate deployment calls on the app's behalf instead of
+// a personal access token.
+// POST /app/installations/:installation_id/access_tokens
+func installationToken(apiURL, appID, installationID, privateKeyPEM string) (string, error) {
+	appToken, err := appJWT(appID, privateKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", apiURL, installationID)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+appToken)
+	req.Header.Add("Accept", "application/vnd.github+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request installation token: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Errorf("Error when closing HTTP response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("server error, unexpected status code: %s", resp.Status)
+	}
+
+	var tokenResp installationTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode installation token response: %s", err)
+	}
+
+	return tokenResp.Token, nil
+}
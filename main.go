@@ -1,47 +1,64 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
 	"strings"
-	"io/ioutil"
 
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-tools/go-steputils/stepconf"
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
 )
 
+// defaultAPIURL is the GitHub REST API base used when api_base_url is unset.
+const defaultAPIURL = "https://api.github.com"
+
 type config struct {
-	AuthToken     string `env:"auth_token,required"`
+	AuthToken     string `env:"auth_token"`
 	RepositoryURL string `env:"repository_url,required"`
 	CommitHash    string `env:"commit_hash,required"`
 	APIURL        string `env:"api_base_url"`
 
-	State            string `env:"set_specific_status,opt[auto,pending,success,error,failure]"`
+	AppID          string `env:"app_id"`
+	InstallationID string `env:"installation_id"`
+	PrivateKey     string `env:"private_key"`
+
+	Environment      string `env:"environment"`
+	Task             string `env:"task"`
+	AutoMerge        bool   `env:"auto_merge"`
+	RequiredContexts string `env:"required_contexts"`
+	Payload          string `env:"payload"`
+
+	ProductionEnvironment string `env:"production_environment,opt[,yes,no]"`
+	TransientEnvironment  string `env:"transient_environment,opt[,yes,no]"`
+
+	Mode         string `env:"mode,opt[full,create_deployment,update_status]"`
+	DeploymentID string `env:"deployment_id"`
+
+	DeactivatePrevious bool   `env:"deactivate_previous"`
+	MaxRetries         string `env:"max_retries"`
+
+	State            string `env:"set_specific_status,opt[auto,pending,queued,in_progress,success,error,failure,inactive]"`
 	BuildURL         string `env:"build_url"`
+	EnvironmentURL   string `env:"environment_url"`
+	LogURL           string `env:"log_url"`
 	StatusIdentifier string `env:"status_identifier"`
 	Description      string `env:"description"`
 	Verbose          bool   `env:"verbose"`
 }
 
-type deploymentRequest struct {
-	RequiredContexts []string   `json:"required_contexts"`
-	Ref         string `json:"ref"`
-	Environment string `json:"environment"`
-	State       string `json:"state"`
-	TargetURL   string `json:"target_url,omitempty"`
-	Description string `json:"description,omitempty"`
-	Context     string `json:"context,omitempty"`
-}
-
-type deploymentStatusRequest struct {
-	EnvironmentUrl string `json:"environment_url"`
-	Environment string `json:"environment"`
-	State       string `json:"state"`
-	Description string `json:"description,omitempty"`
+// deploymentStatus carries the fields needed to post one deployment status
+// update, independent of where the deployment itself was created.
+type deploymentStatus struct {
+	State          string
+	Description    string
+	EnvironmentURL string
+	LogURL         string
 }
 
 // ownerAndRepo returns the owner and the repository part of a git repository url. Possible url formats:
@@ -53,6 +70,100 @@ func ownerAndRepo(url string) (string, string) {
 	return a[1], strings.TrimSuffix(a[2], ".git")
 }
 
+func getEnvironment(env string) string {
+	if env == "" {
+		return "staging"
+	}
+	return env
+}
+
+func getTask(task string) string {
+	if task == "" {
+		return "deploy"
+	}
+	return task
+}
+
+// requiredContextsNone is the required_contexts input value that explicitly
+// requests an empty required_contexts list (skip all required status
+// checks). A Bitrise step always exports its declared inputs as env vars, so
+// a blank required_contexts can't be told apart from "not provided" by
+// presence alone; blank therefore means "unset, let GitHub apply its
+// defaults" and this sentinel is the only way to request an explicit [].
+const requiredContextsNone = "none"
+
+// requiredContexts builds the required_contexts field for a deployment
+// request. An unset (blank) input omits the field so GitHub applies its own
+// defaults (all status checks required); the requiredContextsNone sentinel
+// sends an explicit empty list, which skips all required status checks.
+func requiredContexts(contexts string) *[]string {
+	if contexts == "" {
+		return nil
+	}
+	if contexts == requiredContextsNone {
+		empty := []string{}
+		return &empty
+	}
+	parts := strings.Split(contexts, ",")
+	for i, p := range parts {
+		parts[i] = strings.TrimSpace(p)
+	}
+	return &parts
+}
+
+// payloadOrNil wraps a raw JSON payload input so it's omitted from the
+// deployment request entirely when the input is blank.
+func payloadOrNil(payload string) interface{} {
+	if payload == "" {
+		return nil
+	}
+	return json.RawMessage(payload)
+}
+
+// optionalBool turns a tri-state "", "yes", "no" input into a *bool, leaving
+// the field unset (nil) when the input wasn't provided.
+func optionalBool(value string) *bool {
+	switch value {
+	case "yes":
+		b := true
+		return &b
+	case "no":
+		b := false
+		return &b
+	default:
+		return nil
+	}
+}
+
+// getMaxRetries parses the max_retries input, defaulting to 5 when unset or
+// not a valid number.
+func getMaxRetries(maxRetries string) int {
+	if maxRetries == "" {
+		return 5
+	}
+	n, err := strconv.Atoi(maxRetries)
+	if err != nil {
+		return 5
+	}
+	return n
+}
+
+func getMode(mode string) string {
+	if mode == "" {
+		return "full"
+	}
+	return mode
+}
+
+// environmentURL prefers the dedicated environment_url input, falling back to
+// build_url so existing configurations that only set build_url keep working.
+func environmentURL(environmentURL, buildURL string) string {
+	if environmentURL != "" {
+		return environmentURL
+	}
+	return buildURL
+}
+
 func getState(preset string) string {
 	if preset != "auto" {
 		return preset
@@ -65,18 +176,24 @@ func getState(preset string) string {
 
 func getDescription(desc, state string) string {
 	if desc == "" {
-		strings.Title(getState(state))
+		return strings.Title(getState(state))
 	}
 	return desc
 }
 
-func httpDump(req *http.Request, resp *http.Response) (string, error) {
-	responseStr, err := httputil.DumpResponse(resp, true)
+// dumpGithubResponse renders the raw request/response pair behind a go-github
+// call, for verbose logging.
+func dumpGithubResponse(resp *github.Response) (string, error) {
+	if resp == nil || resp.Response == nil {
+		return "", nil
+	}
+
+	responseStr, err := httputil.DumpResponse(resp.Response, true)
 	if err != nil {
 		return "", fmt.Errorf("unable to dump response, error: %s", err)
 	}
 
-	requestStr, err := httputil.DumpRequest(req, true)
+	requestStr, err := httputil.DumpRequest(resp.Request, true)
 	if err != nil {
 		return "", fmt.Errorf("unable to dump request, error: %s", err)
 	}
@@ -84,125 +201,223 @@ func httpDump(req *http.Request, resp *http.Response) (string, error) {
 	return "Request: " + string(requestStr) + "\nResponse: " + string(responseStr), nil
 }
 
+// authToken resolves the bearer token used to authenticate with the GitHub
+// API: a GitHub App installation token when app_id/installation_id/private_key
+// are set, falling back to the plain auth_token personal access token.
+func authToken(cfg config) (string, error) {
+	if cfg.AppID != "" || cfg.InstallationID != "" || cfg.PrivateKey != "" {
+		if cfg.AppID == "" || cfg.InstallationID == "" || cfg.PrivateKey == "" {
+			return "", fmt.Errorf("app_id, installation_id and private_key must all be set to authenticate as a GitHub App")
+		}
+		return installationToken(apiBaseURL(cfg), cfg.AppID, cfg.InstallationID, cfg.PrivateKey)
+	}
 
+	if cfg.AuthToken == "" {
+		return "", fmt.Errorf("either auth_token or app_id, installation_id and private_key is required")
+	}
 
-// createDeployment creates a commit status for the given commit.
-// see also: https://developer.github.com/v3/repos/deployments/#create-a-deployment
-// POST /repos/:owner/:repo/statuses/:sha
-func createDeployment(cfg config) error {
-	owner, repo := ownerAndRepo(cfg.RepositoryURL)
-	url := fmt.Sprintf("%s/repos/%s/%s/deployments", cfg.APIURL, owner, repo)
-	body, err := json.Marshal(deploymentRequest{
-		Ref:         cfg.CommitHash,
-		Environment: "staging",
-		Description: getDescription(cfg.Description, cfg.State),
-		RequiredContexts: make([]string, 0),
-	})
+	return cfg.AuthToken, nil
+}
 
-	if err != nil {
-		return err
+func apiBaseURL(cfg config) string {
+	if cfg.APIURL == "" {
+		return defaultAPIURL
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	return cfg.APIURL
+}
+
+// githubClient builds an authenticated go-github client, pointed at a GitHub
+// Enterprise instance when api_base_url is set to something other than the
+// public API.
+func githubClient(cfg config) (*github.Client, error) {
+	token, err := authToken(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	req.Header.Add("Authorization", "token "+cfg.AuthToken)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send the request: %s", err)
+	httpClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	httpClient.Transport = &retryTransport{next: httpClient.Transport, maxRetries: getMaxRetries(cfg.MaxRetries)}
+
+	if apiBaseURL(cfg) == defaultAPIURL {
+		return github.NewClient(httpClient), nil
 	}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Errorf("Error when closing HTTP response body:", err)
-		}
-	}()
+	return github.NewEnterpriseClient(cfg.APIURL, cfg.APIURL, httpClient)
+}
 
-	if resp.StatusCode != 201 || cfg.Verbose {
-		d, err := httpDump(req, resp)
+// listAllDeployments fetches every page of deployments matching opts.
+func listAllDeployments(client *github.Client, owner, repo string, opts *github.DeploymentsListOptions) ([]*github.Deployment, error) {
+	opts.PerPage = 100
+
+	var all []*github.Deployment
+	for {
+		deployments, resp, err := client.Repositories.ListDeployments(context.Background(), owner, repo, opts)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		fmt.Println(d)
-	}
+		all = append(all, deployments...)
 
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("server error, unexpected status code: %s", resp.Status)
+		if resp.NextPage == 0 {
+			return all, nil
+		}
+		opts.Page = resp.NextPage
 	}
+}
 
-
-	type Response struct {
-		Id  int `json: "id"`
-		Url string `json: "url"`
+// findExistingDeployment looks for a deployment already created for the same
+// commit, environment and task, so re-running the step doesn't create a
+// duplicate deployment.
+// see also: https://developer.github.com/v3/repos/deployments/#list-deployments
+func findExistingDeployment(client *github.Client, owner, repo string, cfg config) (*github.Deployment, error) {
+	deployments, err := listAllDeployments(client, owner, repo, &github.DeploymentsListOptions{
+		SHA:         cfg.CommitHash,
+		Environment: getEnvironment(cfg.Environment),
+		Task:        getTask(cfg.Task),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list existing deployments: %s", err)
 	}
-	
-
-	body, err2 := ioutil.ReadAll(resp.Body)
-	
-	if err2 != nil {
-		panic(err.Error())
+	if len(deployments) == 0 {
+		return nil, nil
 	}
+	return deployments[0], nil
+}
 
-	var response Response
-	json.Unmarshal(body, &response)
+// postDeployment creates a deployment for the given commit and returns its
+// ID, reusing a matching deployment already created for the same commit,
+// environment and task instead of creating a duplicate.
+// see also: https://developer.github.com/v3/repos/deployments/#create-a-deployment
+func postDeployment(cfg config, client *github.Client) (int64, error) {
+	owner, repo := ownerAndRepo(cfg.RepositoryURL)
 
-	var deploymentId int = response.Id
+	if existing, err := findExistingDeployment(client, owner, repo, cfg); err != nil {
+		return 0, err
+	} else if existing != nil {
+		fmt.Println("reusing existing deployment id", existing.GetID())
+		return existing.GetID(), nil
+	}
 
-	fmt.Println("deployment id", deploymentId)
+	deployment, resp, err := client.Repositories.CreateDeployment(context.Background(), owner, repo, &github.DeploymentRequest{
+		Ref:                   github.String(cfg.CommitHash),
+		Task:                  github.String(getTask(cfg.Task)),
+		Environment:           github.String(getEnvironment(cfg.Environment)),
+		Payload:               payloadOrNil(cfg.Payload),
+		AutoMerge:             &cfg.AutoMerge,
+		RequiredContexts:      requiredContexts(cfg.RequiredContexts),
+		ProductionEnvironment: optionalBool(cfg.ProductionEnvironment),
+		TransientEnvironment:  optionalBool(cfg.TransientEnvironment),
+		Description:           github.String(getDescription(cfg.Description, cfg.State)),
+	})
 
-	return createDeploymentStatus(cfg, deploymentId)
+	if cfg.Verbose {
+		if d, dumpErr := dumpGithubResponse(resp); dumpErr == nil {
+			fmt.Println(d)
+		}
+	}
 
-}
+	if err != nil {
+		return 0, fmt.Errorf("failed to create deployment: %s", err)
+	}
 
+	fmt.Println("deployment id", deployment.GetID())
 
-func createDeploymentStatus(cfg config, deploymentId int) error {
-	owner, repo := ownerAndRepo(cfg.RepositoryURL)
-	url := fmt.Sprintf("%s/repos/%s/%s/deployments/%d/statuses", cfg.APIURL, owner, repo, deploymentId)
+	return deployment.GetID(), nil
+}
 
-	body, err := json.Marshal(deploymentStatusRequest{
-		Environment:     "staging",
-		Description:     getDescription(cfg.Description, cfg.State),
-		State:           getState(cfg.State),
-		EnvironmentUrl:  cfg.BuildURL,
-	})
+// createDeployment creates a deployment for the given commit and immediately
+// reports cfg's configured status against it. This is the step's original,
+// single-invocation behavior (mode "full").
+func createDeployment(cfg config) error {
+	client, err := githubClient(cfg)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+
+	deploymentId, err := postDeployment(cfg, client)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Authorization", "token "+cfg.AuthToken)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send the request: %s", err)
+	return createDeploymentStatus(cfg, client, deploymentId, deploymentStatus{
+		State:          getState(cfg.State),
+		Description:    getDescription(cfg.Description, cfg.State),
+		EnvironmentURL: environmentURL(cfg.EnvironmentURL, cfg.BuildURL),
+		LogURL:         cfg.LogURL,
+	})
+}
+
+// createDeploymentStatus posts one deployment status update for an existing
+// deployment. It's used both by the "full" flow right after creation and
+// standalone by mode "update_status", e.g. to report an interim in_progress
+// status at deploy start and a terminal success/failure status at deploy end.
+// see also: https://developer.github.com/v3/repos/deployments/#create-a-deployment-status
+func createDeploymentStatus(cfg config, client *github.Client, deploymentId int64, status deploymentStatus) error {
+	owner, repo := ownerAndRepo(cfg.RepositoryURL)
+
+	req := &github.DeploymentStatusRequest{
+		State:       github.String(status.State),
+		Description: github.String(status.Description),
+		Environment: github.String(getEnvironment(cfg.Environment)),
+	}
+	if status.EnvironmentURL != "" {
+		req.EnvironmentURL = github.String(status.EnvironmentURL)
+	}
+	if status.LogURL != "" {
+		req.LogURL = github.String(status.LogURL)
 	}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Errorf("Error when closing HTTP response body:", err)
-		}
-	}()
+	_, resp, err := client.Repositories.CreateDeploymentStatus(context.Background(), owner, repo, deploymentId, req)
 
-	if resp.StatusCode != 201 || cfg.Verbose {
-		d, err := httpDump(req, resp)
-		if err != nil {
-			return err
+	if cfg.Verbose {
+		if d, dumpErr := dumpGithubResponse(resp); dumpErr == nil {
+			fmt.Println(d)
 		}
-		fmt.Println(d)
 	}
 
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("server error, unexpected status code: %s", resp.Status)
+	if err != nil {
+		return fmt.Errorf("failed to create deployment status: %s", err)
+	}
+
+	if status.State == "success" && cfg.DeactivatePrevious {
+		return deactivatePreviousDeployments(client, owner, repo, getEnvironment(cfg.Environment), deploymentId)
 	}
 
 	return nil
 }
 
+// deactivatePreviousDeployments marks every other deployment to the same
+// environment as inactive, the documented GitHub pattern for superseding
+// older deployments once a new one has succeeded.
+// see also: https://developer.github.com/v3/repos/deployments/#create-a-deployment-status
+func deactivatePreviousDeployments(client *github.Client, owner, repo, environment string, keepDeploymentId int64) error {
+	deployments, err := listAllDeployments(client, owner, repo, &github.DeploymentsListOptions{
+		Environment: environment,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list deployments to deactivate: %s", err)
+	}
 
+	for _, d := range deployments {
+		if d.GetID() == keepDeploymentId {
+			continue
+		}
 
+		req, err := client.NewRequest("POST", fmt.Sprintf("repos/%s/%s/deployments/%d/statuses", owner, repo, d.GetID()), &github.DeploymentStatusRequest{
+			State:       github.String("inactive"),
+			Environment: github.String(environment),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to build inactive status request: %s", err)
+		}
+		req.Header.Set("Accept", "application/vnd.github.ant-man-preview+json, application/vnd.github.flash-preview+json")
+
+		if _, err := client.Do(context.Background(), req, nil); err != nil {
+			return fmt.Errorf("failed to deactivate deployment %d: %s", d.GetID(), err)
+		}
+	}
+
+	return nil
+}
 
 func main() {
 	var cfg config
@@ -212,9 +427,36 @@ func main() {
 	}
 	stepconf.Print(cfg)
 
-	if err := createDeployment(cfg); err != nil {
+	var err error
+	switch getMode(cfg.Mode) {
+	case "create_deployment":
+		var client *github.Client
+		if client, err = githubClient(cfg); err != nil {
+			break
+		}
+		_, err = postDeployment(cfg, client)
+	case "update_status":
+		var deploymentId int64
+		if deploymentId, err = strconv.ParseInt(cfg.DeploymentID, 10, 64); err != nil {
+			err = fmt.Errorf("deployment_id: %s", err)
+			break
+		}
+		var client *github.Client
+		if client, err = githubClient(cfg); err != nil {
+			break
+		}
+		err = createDeploymentStatus(cfg, client, deploymentId, deploymentStatus{
+			State:          getState(cfg.State),
+			Description:    getDescription(cfg.Description, cfg.State),
+			EnvironmentURL: environmentURL(cfg.EnvironmentURL, cfg.BuildURL),
+			LogURL:         cfg.LogURL,
+		})
+	default:
+		err = createDeployment(cfg)
+	}
+
+	if err != nil {
 		log.Errorf("Error: %s\n", err)
 		os.Exit(1)
 	}
-
 }
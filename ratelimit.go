@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryTransport wraps an http.RoundTripper, retrying requests that hit
+// GitHub's primary or secondary rate limits (403/429) or transient server
+// errors (5xx). It honors Retry-After and X-RateLimit-Reset when present and
+// falls back to exponential backoff, giving up after maxRetries retries.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !shouldRetryRequest(resp) || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		wait := retryDelay(resp, attempt)
+		drainAndClose(resp)
+
+		// GET requests (e.g. ListDeployments) have no body to reset; only
+		// requests with one need GetBody to rewind it before retrying.
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+
+		time.Sleep(wait)
+	}
+}
+
+func shouldRetryRequest(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func drainAndClose(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// retryDelay works out how long to wait before retrying, honoring whichever
+// of GitHub's rate-limit signals is present on the response: Retry-After
+// (seconds or an HTTP-date, sent on secondary/abuse rate limits) or
+// X-RateLimit-Reset (sent once the primary rate limit is exhausted). Absent
+// either, it falls back to exponential backoff.
+func retryDelay(resp *http.Response, attempt int) time.Duration {
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			if d := time.Until(date); d > 0 {
+				return d
+			}
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset := resp.Header.Get("X-RateLimit-Reset"); reset != "" {
+			if unix, err := strconv.ParseInt(reset, 10, 64); err == nil {
+				if d := time.Until(time.Unix(unix, 0)); d > 0 {
+					return d
+				}
+			}
+		}
+	}
+
+	return time.Duration(1<<uint(attempt)) * time.Second
+}